@@ -0,0 +1,79 @@
+package helpers
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// oidcDiscoveryTimeout bounds the discovery request so a hung UAA (or
+// proxy in front of it) can't wedge InitSettings at process startup.
+const oidcDiscoveryTimeout = 10 * time.Second
+
+// defaultOAuthScopes is used when OAUTH_SCOPES isn't set, preserving the
+// scopes cf-deck has always requested.
+var defaultOAuthScopes = []string{"cloud_controller.read", "cloud_controller.write", "cloud_controller.admin", "scim.read", "openid"}
+
+// defaultOAuthAdminScopes is used when OAUTH_ADMIN_SCOPES isn't set.
+var defaultOAuthAdminScopes = []string{"scim.invite", "cloud_controller.admin", "scim.read"}
+
+// oidcDiscoveryDocument is the subset of an OpenID Connect discovery
+// document (RFC 8414 / OIDC Discovery 1.0) we care about.
+type oidcDiscoveryDocument struct {
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// oauthScopes splits a comma-separated OAUTH_SCOPES-style env var into a
+// scope list, falling back to fallback when unset.
+func oauthScopes(spec string, fallback []string) []string {
+	if spec == "" {
+		return fallback
+	}
+	parts := strings.Split(spec, ",")
+	scopes := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			scopes = append(scopes, p)
+		}
+	}
+	return scopes
+}
+
+// discoverOIDCEndpoints fetches uaaURL's OIDC discovery document and
+// returns its authorization, token, and JWKS endpoints, for operators who
+// want cf-deck to point at a UAA fork/proxy without recompiling. localCF
+// mirrors Settings.CreateContext: when targeting a local CF environment
+// we won't have valid SSL certs, so certificate verification is skipped.
+func discoverOIDCEndpoints(uaaURL string, localCF bool) (authURL, tokenURL, jwksURL string, err error) {
+	client := &http.Client{Timeout: oidcDiscoveryTimeout}
+	if localCF {
+		client.Transport = &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+		}
+	}
+
+	resp, err := client.Get(strings.TrimRight(uaaURL, "/") + "/.well-known/openid-configuration")
+	if err != nil {
+		return "", "", "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", "", "", fmt.Errorf("helpers: OIDC discovery at %s returned %s", uaaURL, resp.Status)
+	}
+
+	var doc oidcDiscoveryDocument
+	if err := json.NewDecoder(resp.Body).Decode(&doc); err != nil {
+		return "", "", "", err
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" {
+		return "", "", "", fmt.Errorf("helpers: OIDC discovery document from %s is missing endpoints", uaaURL)
+	}
+
+	return doc.AuthorizationEndpoint, doc.TokenEndpoint, doc.JWKSURI, nil
+}
@@ -0,0 +1,156 @@
+package helpers
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// rateLimiter is satisfied by both the Redis-backed and in-process
+// implementations Settings.CheckAuthRate dispatches to.
+type rateLimiter interface {
+	// Allow reports whether another hit against scope/key is permitted,
+	// and if not, how long the caller should wait before retrying.
+	Allow(scope, key string) (allowed bool, retryAfter time.Duration, err error)
+}
+
+// parseAuthRateLimit parses the AUTH_RATE_LIMIT env var format, "N/duration"
+// (e.g. "5/30m"): at most N attempts per window.
+func parseAuthRateLimit(spec string) (limit int, window time.Duration, err error) {
+	parts := strings.SplitN(spec, "/", 2)
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("helpers: invalid %s %q, want N/duration", AuthRateLimitEnvVar, spec)
+	}
+
+	limit, err = strconv.Atoi(parts[0])
+	if err != nil || limit <= 0 {
+		return 0, 0, fmt.Errorf("helpers: invalid %s %q, limit must be a positive integer", AuthRateLimitEnvVar, spec)
+	}
+
+	window, err = time.ParseDuration(parts[1])
+	if err != nil || window <= 0 {
+		return 0, 0, fmt.Errorf("helpers: invalid %s %q, window must be a positive duration", AuthRateLimitEnvVar, spec)
+	}
+
+	return limit, window, nil
+}
+
+// CheckAuthRate reports whether a login attempt scoped to key (e.g. a
+// client IP or UAA username) is within AUTH_RATE_LIMIT. When over the
+// limit, retryAfter is how long the caller should wait before the next
+// attempt is allowed. It's a no-op (always allowed) when AUTH_RATE_LIMIT
+// isn't configured.
+func (s *Settings) CheckAuthRate(scope, key string) (allowed bool, retryAfter time.Duration, err error) {
+	if s.rateLimiter == nil {
+		return true, 0, nil
+	}
+	return s.rateLimiter.Allow(scope, key)
+}
+
+// redisRateLimiter implements a fixed-window counter in Redis: the first
+// hit in a window sets the key's TTL, and every hit increments it.
+// Exceeding limit within the window denies the request until PTTL expires.
+type redisRateLimiter struct {
+	pool   RedisPool
+	limit  int
+	window time.Duration
+}
+
+func (r *redisRateLimiter) Allow(scope, key string) (bool, time.Duration, error) {
+	redisKey := fmt.Sprintf("ratelimit:%s:%s", scope, key)
+
+	c := r.pool.Get()
+	defer c.Close()
+
+	count, err := redis.Int(c.Do("INCR", redisKey))
+	if err != nil {
+		return false, 0, err
+	}
+	if count == 1 {
+		if _, err := c.Do("EXPIRE", redisKey, int(r.window.Seconds())); err != nil {
+			return false, 0, err
+		}
+	}
+
+	if count <= r.limit {
+		return true, 0, nil
+	}
+
+	ttl, err := redis.Int64(c.Do("PTTL", redisKey))
+	if err != nil {
+		return false, 0, err
+	}
+	if ttl < 0 {
+		// No TTL (e.g. race with EXPIRE, or a key that predates this
+		// limiter); fall back to the configured window.
+		ttl = r.window.Milliseconds()
+	}
+	return false, time.Duration(ttl) * time.Millisecond, nil
+}
+
+// localRateLimiter is an in-process, map-based fixed-window counter used
+// when no Redis backend is configured, so tests and local dev still
+// enforce AUTH_RATE_LIMIT. Unlike redisRateLimiter it has no TTL to lean
+// on for eviction, so a background sweep prunes expired windows to keep
+// the map from growing without bound (e.g. one entry per distinct
+// attacking IP, for the process lifetime).
+type localRateLimiter struct {
+	limit  int
+	window time.Duration
+
+	mu      sync.Mutex
+	windows map[string]*localWindow
+}
+
+type localWindow struct {
+	count     int
+	expiresAt time.Time
+}
+
+func newLocalRateLimiter(limit int, window time.Duration) *localRateLimiter {
+	r := &localRateLimiter{limit: limit, window: window, windows: make(map[string]*localWindow)}
+	go r.sweepExpired()
+	return r
+}
+
+// sweepExpired periodically prunes windows that have already lapsed.
+// Running it on the window's own period is enough: an expired window
+// can't be resurrected (Allow replaces it on next access), it just sits
+// there wasting memory until swept.
+func (r *localRateLimiter) sweepExpired() {
+	ticker := time.NewTicker(r.window)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		r.mu.Lock()
+		for key, w := range r.windows {
+			if now.After(w.expiresAt) {
+				delete(r.windows, key)
+			}
+		}
+		r.mu.Unlock()
+	}
+}
+
+func (r *localRateLimiter) Allow(scope, key string) (bool, time.Duration, error) {
+	mapKey := fmt.Sprintf("%s:%s", scope, key)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	w, ok := r.windows[mapKey]
+	if !ok || now.After(w.expiresAt) {
+		w = &localWindow{count: 0, expiresAt: now.Add(r.window)}
+		r.windows[mapKey] = w
+	}
+	w.count++
+
+	if w.count <= r.limit {
+		return true, 0, nil
+	}
+	return false, w.expiresAt.Sub(now), nil
+}
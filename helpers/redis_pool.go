@@ -0,0 +1,302 @@
+package helpers
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cloudfoundry-community/go-cfenv"
+	"github.com/garyburd/redigo/redis"
+)
+
+// reconnectBackoffCap is the ceiling on the exponential backoff used while
+// rebuilding a pool against a freshly-discovered master.
+const reconnectBackoffCap = 30 * time.Second
+
+// RedisPool is the minimal surface every Redis-backed subsystem (sessions,
+// rate limiting, ...) needs. Both a plain *redis.Pool and our
+// Sentinel-aware pool satisfy it, so callers don't need to care which one
+// they were handed.
+type RedisPool interface {
+	Get() redis.Conn
+}
+
+// buildRedisPool creates the Redis pool shared across the app, choosing
+// between a direct connection and a Sentinel-discovered master depending
+// on RedisSentinelAddrsEnvVar, and wiring TLS in when RedisTLSEnvVar is
+// set. The returned health check reports degraded (rather than flapping
+// true/false) while a Sentinel failover is being recovered from.
+func buildRedisPool(envVars *EnvVars, env *cfenv.App) (RedisPool, func() bool, error) {
+	var tlsConf *tls.Config
+	if envVars.BoolGet(RedisTLSEnvVar) {
+		tlsConf = &tls.Config{}
+	}
+
+	if sentinelAddrs := envVars.Get(RedisSentinelAddrsEnvVar, ""); sentinelAddrs != "" {
+		masterName := envVars.MustGet(RedisSentinelMasterEnvVar)
+		_, password, err := getRedisSettings(env)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		addrs := strings.Split(sentinelAddrs, ",")
+		for i := range addrs {
+			addrs[i] = strings.TrimSpace(addrs[i])
+		}
+
+		pool, err := newSentinelRedisPool(addrs, masterName, password, tlsConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		healthCheck := func() bool {
+			if pool.Degraded() {
+				log.Printf("{\"health-check\": \"degraded\", \"reason\": \"redis sentinel failover in progress\"}")
+				return false
+			}
+			return true
+		}
+		return pool, healthCheck, nil
+	}
+
+	address, password, err := getRedisSettings(env)
+	if err != nil {
+		return nil, nil, err
+	}
+	pool := newRedisPool(address, password)
+	if tlsConf != nil {
+		pool.Dial = tlsDialer(address, password, tlsConf)
+	}
+	healthCheck := func() bool {
+		c := pool.Get()
+		defer c.Close()
+		_, pingErr := c.Do("PING")
+		if pingErr != nil {
+			log.Printf("{\"health-check-error\": \"%s\"}", pingErr)
+			return false
+		}
+		return true
+	}
+	return pool, healthCheck, nil
+}
+
+// tlsDialer builds a dialer identical to the one newRedisPool uses, except
+// it negotiates TLS with the server.
+func tlsDialer(address, password string, tlsConf *tls.Config) func() (redis.Conn, error) {
+	return func() (redis.Conn, error) {
+		c, err := redis.Dial("tcp", address,
+			redis.DialConnectTimeout(10*time.Second),
+			redis.DialWriteTimeout(10*time.Second),
+			redis.DialReadTimeout(10*time.Second),
+			redis.DialUseTLS(true),
+			redis.DialTLSConfig(tlsConf))
+		if err != nil {
+			return nil, err
+		}
+		if password != "" {
+			if _, authErr := c.Do("AUTH", password); authErr != nil {
+				c.Close()
+				return nil, authErr
+			}
+		}
+		return c, nil
+	}
+}
+
+// sentinelRedisPool wraps a *redis.Pool whose connections are dialed
+// against whatever node Sentinel currently reports as master. On
+// connection errors that look like a failover (EOF, connection refused,
+// READONLY) it tears the pool down and rebuilds it against the
+// newly-elected master, backing off exponentially (capped at
+// reconnectBackoffCap) between attempts so a flapping Sentinel doesn't
+// cause a reconnect storm.
+type sentinelRedisPool struct {
+	addrs      []string
+	masterName string
+	password   string
+	tlsConf    *tls.Config
+
+	mu   sync.RWMutex
+	pool *redis.Pool
+
+	reconnecting int32
+	// degraded is true while a reconnect is in flight, so health checks
+	// can report "degraded" instead of flapping true/false on every
+	// single failed PING during a failover.
+	degraded int32
+}
+
+// newSentinelRedisPool discovers the current master via Sentinel and
+// returns a pool dialing against it, re-resolving automatically on
+// connection errors that indicate the master changed.
+func newSentinelRedisPool(addrs []string, masterName, password string, tlsConf *tls.Config) (*sentinelRedisPool, error) {
+	p := &sentinelRedisPool{addrs: addrs, masterName: masterName, password: password, tlsConf: tlsConf}
+	pool, err := p.dialMaster()
+	if err != nil {
+		return nil, err
+	}
+	p.pool = pool
+	return p, nil
+}
+
+// querySentinelMaster asks each Sentinel address in turn for the current
+// master of masterName (the SENTINEL get-master-addr-by-name command),
+// returning the first one that answers. This talks plain RESP over
+// garyburd/redigo directly rather than pulling in a Sentinel client
+// library, since every such library on the market is built against the
+// gomodule/redigo fork and is not interchangeable with garyburd/redigo's
+// redis.Conn/redis.Pool types used throughout the rest of this package.
+func querySentinelMaster(addrs []string, masterName string) (string, error) {
+	var lastErr error
+	for _, addr := range addrs {
+		c, err := redis.Dial("tcp", addr,
+			redis.DialConnectTimeout(10*time.Second),
+			redis.DialReadTimeout(10*time.Second),
+			redis.DialWriteTimeout(10*time.Second))
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		reply, err := redis.Strings(c.Do("SENTINEL", "get-master-addr-by-name", masterName))
+		c.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(reply) != 2 {
+			lastErr = fmt.Errorf("helpers: sentinel %s returned a malformed master address", addr)
+			continue
+		}
+		return net.JoinHostPort(reply[0], reply[1]), nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("helpers: no reachable sentinel in %v", addrs)
+	}
+	return "", fmt.Errorf("helpers: could not resolve redis master %q via sentinel: %w", masterName, lastErr)
+}
+
+func (p *sentinelRedisPool) dialMaster() (*redis.Pool, error) {
+	address, err := querySentinelMaster(p.addrs, p.masterName)
+	if err != nil {
+		return nil, err
+	}
+
+	return &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, pingErr := c.Do("PING")
+			return pingErr
+		},
+		Dial: func() (redis.Conn, error) {
+			opts := []redis.DialOption{
+				redis.DialConnectTimeout(10 * time.Second),
+				redis.DialWriteTimeout(10 * time.Second),
+				redis.DialReadTimeout(10 * time.Second),
+			}
+			if p.tlsConf != nil {
+				opts = append(opts, redis.DialUseTLS(true), redis.DialTLSConfig(p.tlsConf))
+			}
+			c, dialErr := redis.Dial("tcp", address, opts...)
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			if p.password != "" {
+				if _, authErr := c.Do("AUTH", p.password); authErr != nil {
+					c.Close()
+					return nil, authErr
+				}
+			}
+			return c, nil
+		},
+	}, nil
+}
+
+// Get returns a connection from the current pool, wrapped so that errors
+// indicating a failover trigger an async rebuild against the new master.
+func (p *sentinelRedisPool) Get() redis.Conn {
+	p.mu.RLock()
+	pool := p.pool
+	p.mu.RUnlock()
+	return &reconnectingConn{Conn: pool.Get(), owner: p}
+}
+
+// Degraded reports whether a reconnect against a new master is currently
+// in flight.
+func (p *sentinelRedisPool) Degraded() bool {
+	return atomic.LoadInt32(&p.degraded) == 1
+}
+
+func (p *sentinelRedisPool) noteError(err error) {
+	if !isFailoverErr(err) {
+		return
+	}
+	if !atomic.CompareAndSwapInt32(&p.reconnecting, 0, 1) {
+		// A reconnect loop is already running.
+		return
+	}
+	atomic.StoreInt32(&p.degraded, 1)
+	go p.reconnectLoop()
+}
+
+func (p *sentinelRedisPool) reconnectLoop() {
+	defer atomic.StoreInt32(&p.reconnecting, 0)
+
+	backoff := 1 * time.Second
+	for {
+		pool, err := p.dialMaster()
+		if err == nil {
+			c := pool.Get()
+			_, pingErr := c.Do("PING")
+			c.Close()
+			if pingErr == nil {
+				p.mu.Lock()
+				old := p.pool
+				p.pool = pool
+				p.mu.Unlock()
+				old.Close()
+				atomic.StoreInt32(&p.degraded, 0)
+				return
+			}
+			err = pingErr
+		}
+
+		log.Printf("{\"redis-reconnect-error\": \"%s\", \"retry-in\": \"%s\"}", err, backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > reconnectBackoffCap {
+			backoff = reconnectBackoffCap
+		}
+	}
+}
+
+// reconnectingConn wraps a redis.Conn so that any command error is
+// inspected for failover signatures and fed back to the owning pool.
+type reconnectingConn struct {
+	redis.Conn
+	owner *sentinelRedisPool
+}
+
+func (c *reconnectingConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	reply, err := c.Conn.Do(cmd, args...)
+	if err != nil {
+		c.owner.noteError(err)
+	}
+	return reply, err
+}
+
+func isFailoverErr(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := err.Error()
+	return strings.Contains(msg, "EOF") ||
+		strings.Contains(msg, "connection refused") ||
+		strings.Contains(msg, "READONLY")
+}
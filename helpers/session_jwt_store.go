@@ -0,0 +1,214 @@
+package helpers
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/sessions"
+)
+
+// jwtValuesClaim is the gob-encoded, base64-wrapped session.Values carried
+// as a custom claim, alongside the standard exp/last_used claims.
+const jwtValuesClaim = "values"
+
+// jwtCreatedAtKey is a reserved session.Values entry JWTStore uses to
+// carry a session's original issuance time from New through to the
+// matching Save, so that re-signing on every request (to slide
+// last_used) doesn't also push exp forward indefinitely. It's populated
+// by decode and consumed (and stripped back out) by encode, so it is
+// present on session.Values between New and Save but is never encoded
+// into the values claim.
+const jwtCreatedAtKey = "_jwt_created_at"
+
+// JWTStore is a stateless gorilla sessions.Store: it never touches Redis
+// or the filesystem, instead serializing the session values (including
+// the gob-registered oauth2.Token) into a signed or encrypted JWT that is
+// the entire cookie. That makes it safe to run behind any number of
+// cf-deck instances without shared session storage, unlike the file
+// backend.
+type JWTStore struct {
+	Options *sessions.Options
+
+	// signingKey authenticates the JWT (HS256). encryptionKey, if set,
+	// additionally encrypts it (A256GCM) so the claims aren't readable by
+	// the browser.
+	signingKey    []byte
+	encryptionKey []byte
+
+	// IdleTimeout is how long a token may go unused before it's rejected,
+	// enforced via the last_used claim independent of the token's
+	// absolute exp.
+	IdleTimeout time.Duration
+}
+
+// NewJWTStore builds a JWTStore. encryptionKey may be nil, in which case
+// the JWT is signed but its claims are readable (base64) like any JWT.
+func NewJWTStore(signingKey, encryptionKey []byte) *JWTStore {
+	return &JWTStore{
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: expirationConstant,
+		},
+		signingKey:    signingKey,
+		encryptionKey: encryptionKey,
+	}
+}
+
+func (s *JWTStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+func (s *JWTStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+
+	values, err := s.decode(cookie.Value)
+	if err != nil {
+		// Expired, tampered, or foreign token: treat as a fresh session.
+		return session, nil
+	}
+	session.Values = values
+	session.IsNew = false
+	return session, nil
+}
+
+func (s *JWTStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	token, err := s.encode(session.Values, session.Options.MaxAge)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), token, session.Options))
+	return nil
+}
+
+func (s *JWTStore) encode(values map[interface{}]interface{}, maxAge int) (string, error) {
+	now := time.Now()
+
+	// A session decoded by New carries its original issuance time under
+	// jwtCreatedAtKey; a brand new session has none, so it's created now.
+	// Either way, exp is anchored to createdAt, not to this Save call, so
+	// sliding last_used below never extends the absolute lifetime.
+	createdAt := now
+	if unix, ok := values[jwtCreatedAtKey].(int64); ok {
+		createdAt = time.Unix(unix, 0)
+	}
+	delete(values, jwtCreatedAtKey)
+
+	encodedValues, err := encodeValues(values)
+	if err != nil {
+		return "", err
+	}
+
+	claims := jwt.MapClaims{
+		"iat":          createdAt.Unix(),
+		"exp":          createdAt.Add(time.Duration(maxAge) * time.Second).Unix(),
+		"last_used":    now.Unix(),
+		jwtValuesClaim: encodedValues,
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	signed, err := token.SignedString(s.signingKey)
+	if err != nil {
+		return "", err
+	}
+
+	if s.encryptionKey == nil {
+		return signed, nil
+	}
+	ciphertext, err := encryptWithSecret(s.encryptionKey, []byte(signed))
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(ciphertext), nil
+}
+
+func (s *JWTStore) decode(raw string) (map[interface{}]interface{}, error) {
+	signed := raw
+	if s.encryptionKey != nil {
+		ciphertext, err := base64.URLEncoding.DecodeString(raw)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := decryptWithSecret(s.encryptionKey, ciphertext)
+		if err != nil {
+			return nil, err
+		}
+		signed = string(plaintext)
+	}
+
+	token, err := jwt.Parse(signed, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("helpers: unexpected JWT signing method %v", t.Header["alg"])
+		}
+		return s.signingKey, nil
+	})
+	if err != nil || !token.Valid {
+		return nil, fmt.Errorf("helpers: invalid session token")
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, fmt.Errorf("helpers: malformed session token claims")
+	}
+
+	if s.IdleTimeout > 0 {
+		lastUsed, ok := claims["last_used"].(float64)
+		if !ok {
+			return nil, fmt.Errorf("helpers: missing last_used claim")
+		}
+		if time.Since(time.Unix(int64(lastUsed), 0)) > s.IdleTimeout {
+			return nil, fmt.Errorf("helpers: session token idle timeout exceeded")
+		}
+	}
+
+	encodedValues, ok := claims[jwtValuesClaim].(string)
+	if !ok {
+		return nil, fmt.Errorf("helpers: missing %s claim", jwtValuesClaim)
+	}
+	values, err := decodeValues(encodedValues)
+	if err != nil {
+		return nil, err
+	}
+
+	if iat, ok := claims["iat"].(float64); ok {
+		values[jwtCreatedAtKey] = int64(iat)
+	}
+	return values, nil
+}
+
+func encodeValues(values map[interface{}]interface{}) (string, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(values); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
+
+func decodeValues(encoded string) (map[interface{}]interface{}, error) {
+	raw, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[interface{}]interface{})
+	if err := gob.NewDecoder(bytes.NewReader(raw)).Decode(&values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
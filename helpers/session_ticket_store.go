@@ -0,0 +1,282 @@
+package helpers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// sessionTicket is the opaque value the browser holds. Its shape never
+// changes even though the encrypted payload behind it does, since rotating
+// the per-session secret only touches the Redis-side ciphertext, not the
+// cookie format.
+type sessionTicket struct {
+	ID     string
+	Secret []byte
+}
+
+// sessionRecord is what we actually keep in Redis, encrypted under the
+// ticket's secret. CreatedAt lets us enforce an absolute lifetime
+// independent of the idle TTL that keeps the key alive.
+type sessionRecord struct {
+	Values    map[interface{}]interface{}
+	CreatedAt time.Time
+}
+
+// ticketCreatedAtKey and ticketSecretKey are reserved session.Values
+// entries RedisTicketStore uses to carry a session's original issuance
+// time and its per-session secret from New through to the matching Save.
+// Without them, Save would have no way to tell a session's true origin
+// from a simple re-save, so both MaxLifetime enforcement and secret
+// rotation would (incorrectly) reset on every request. They're populated
+// by New and consumed (and stripped back out) by Save, so they are present
+// on session.Values between the two but are never persisted in the
+// session payload.
+const (
+	ticketCreatedAtKey = "_ticket_created_at"
+	ticketSecretKey    = "_ticket_secret"
+)
+
+// RedisTicketStore is a gorilla sessions.Store that never puts session
+// data on the wire. The cookie only carries a ticket (random session ID +
+// a secret minted fresh for that session, signed with securecookie so it
+// can't be forged); the actual payload lives in Redis, encrypted with the
+// ticket's secret. Deleting the Redis key invalidates the session
+// instantly, even if the browser keeps presenting its cookie.
+type RedisTicketStore struct {
+	Pool    RedisPool
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	// MaxLifetime bounds a session's age regardless of activity.
+	// IdleTimeout is how long a session may go untouched before it's
+	// deleted from Redis, even if MaxLifetime hasn't been reached.
+	MaxLifetime time.Duration
+	IdleTimeout time.Duration
+}
+
+// NewRedisTicketStore builds a RedisTicketStore. ticketKeyPairs are passed
+// straight to securecookie.CodecsFromPairs and authenticate/encrypt the
+// ticket itself (not the session payload, which is keyed per-session).
+func NewRedisTicketStore(pool RedisPool, ticketKeyPairs ...[]byte) *RedisTicketStore {
+	return &RedisTicketStore{
+		Pool:   pool,
+		Codecs: securecookie.CodecsFromPairs(ticketKeyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: expirationConstant,
+		},
+		MaxLifetime: 0,
+		IdleTimeout: 0,
+	}
+}
+
+// Get returns a cached session, registering a new one if none exists yet.
+func (s *RedisTicketStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns a session for the given name without adding it to the
+// registry. It's typically called by Get via the registry.
+func (s *RedisTicketStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	cookie, err := r.Cookie(name)
+	if err != nil {
+		// No cookie yet; this is simply a brand new session.
+		return session, nil
+	}
+
+	ticket := &sessionTicket{}
+	if err := securecookie.DecodeMulti(name, cookie.Value, ticket, s.Codecs...); err != nil {
+		return session, nil
+	}
+
+	record, err := s.load(ticket)
+	if err != nil {
+		// Missing, expired, or tampered server-side record: fall back to
+		// treating this like a fresh session rather than erroring the request.
+		return session, nil
+	}
+	session.ID = ticket.ID
+	session.Values = record.Values
+	session.Values[ticketCreatedAtKey] = record.CreatedAt.UnixNano()
+	session.Values[ticketSecretKey] = ticket.Secret
+	session.IsNew = false
+	return session, nil
+}
+
+// Save persists the session to Redis and writes the ticket cookie. A
+// negative MaxAge deletes the session both from Redis and the browser.
+func (s *RedisTicketStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge < 0 {
+		if session.ID != "" {
+			if err := s.deleteByID(session.ID); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	ticket := &sessionTicket{ID: session.ID}
+	if ticket.ID == "" {
+		id, err := GenerateRandomString(32)
+		if err != nil {
+			return err
+		}
+		ticket.ID = id
+	}
+
+	// A session New() loaded carries its original issuance time and
+	// secret under these reserved keys; a brand new session has neither,
+	// so both are minted here. Either way MaxLifetime is anchored to
+	// createdAt, not to this Save call, and the secret is only rotated at
+	// creation rather than on every save, so two near-simultaneous
+	// requests from the same browser (multi-tab, double-click, prefetch)
+	// can't race and leave the cookie and the Redis ciphertext signed
+	// under different secrets.
+	createdAt := time.Now()
+	if unixNano, ok := session.Values[ticketCreatedAtKey].(int64); ok {
+		createdAt = time.Unix(0, unixNano)
+	}
+	delete(session.Values, ticketCreatedAtKey)
+
+	secret, _ := session.Values[ticketSecretKey].([]byte)
+	delete(session.Values, ticketSecretKey)
+	if secret == nil {
+		secret = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, secret); err != nil {
+			return err
+		}
+	}
+	ticket.Secret = secret
+
+	record := sessionRecord{Values: session.Values, CreatedAt: createdAt}
+	if err := s.store(ticket, record); err != nil {
+		return err
+	}
+	session.ID = ticket.ID
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), ticket, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *RedisTicketStore) key(id string) string {
+	return fmt.Sprintf("session:%s", id)
+}
+
+func (s *RedisTicketStore) store(ticket *sessionTicket, record sessionRecord) error {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(record); err != nil {
+		return err
+	}
+	ciphertext, err := encryptWithSecret(ticket.Secret, buf.Bytes())
+	if err != nil {
+		return err
+	}
+
+	ttl := s.idleTimeoutSeconds()
+	c := s.Pool.Get()
+	defer c.Close()
+	_, err = c.Do("SET", s.key(ticket.ID), ciphertext, "EX", ttl)
+	return err
+}
+
+func (s *RedisTicketStore) load(ticket *sessionTicket) (*sessionRecord, error) {
+	c := s.Pool.Get()
+	defer c.Close()
+
+	ciphertext, err := redis.Bytes(c.Do("GET", s.key(ticket.ID)))
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := decryptWithSecret(ticket.Secret, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+
+	var record sessionRecord
+	if err := gob.NewDecoder(bytes.NewReader(plaintext)).Decode(&record); err != nil {
+		return nil, err
+	}
+
+	if s.MaxLifetime > 0 && time.Since(record.CreatedAt) > s.MaxLifetime {
+		_ = s.deleteByID(ticket.ID)
+		return nil, errors.New("helpers: session exceeded its max lifetime")
+	}
+
+	// Touch the idle TTL so an active session doesn't expire out from
+	// under the user, without resetting CreatedAt (which still bounds
+	// MaxLifetime).
+	_, _ = c.Do("EXPIRE", s.key(ticket.ID), s.idleTimeoutSeconds())
+
+	return &record, nil
+}
+
+func (s *RedisTicketStore) deleteByID(id string) error {
+	c := s.Pool.Get()
+	defer c.Close()
+	_, err := c.Do("DEL", s.key(id))
+	return err
+}
+
+func (s *RedisTicketStore) idleTimeoutSeconds() int {
+	if s.IdleTimeout > 0 {
+		return int(s.IdleTimeout.Seconds())
+	}
+	return expirationConstant
+}
+
+// encryptWithSecret seals plaintext with AES-256-GCM under secret, which
+// must be 32 bytes (the size RedisTicketStore.Save always mints).
+func encryptWithSecret(secret, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func decryptWithSecret(secret, ciphertext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < gcm.NonceSize() {
+		return nil, errors.New("helpers: ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:gcm.NonceSize()], ciphertext[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, sealed, nil)
+}
@@ -0,0 +1,365 @@
+package helpers
+
+import (
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// fakeRedisPool is an in-memory stand-in for the subset of Redis commands
+// RedisTicketStore issues (SET ... EX, GET, EXPIRE, DEL), so its
+// encryption and expiry logic can be tested without a real Redis.
+type fakeRedisPool struct {
+	mu   sync.Mutex
+	data map[string]fakeRedisEntry
+}
+
+type fakeRedisEntry struct {
+	value     []byte
+	expiresAt time.Time
+}
+
+func newFakeRedisPool() *fakeRedisPool {
+	return &fakeRedisPool{data: make(map[string]fakeRedisEntry)}
+}
+
+func (p *fakeRedisPool) Get() redis.Conn {
+	return &fakeRedisConn{pool: p}
+}
+
+type fakeRedisConn struct {
+	pool *fakeRedisPool
+}
+
+func (c *fakeRedisConn) Close() error { return nil }
+func (c *fakeRedisConn) Err() error   { return nil }
+func (c *fakeRedisConn) Send(string, ...interface{}) error {
+	return nil
+}
+func (c *fakeRedisConn) Flush() error                  { return nil }
+func (c *fakeRedisConn) Receive() (interface{}, error) { return nil, nil }
+
+func (c *fakeRedisConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	c.pool.mu.Lock()
+	defer c.pool.mu.Unlock()
+
+	switch cmd {
+	case "SET":
+		key := args[0].(string)
+		value := args[1].([]byte)
+		entry := fakeRedisEntry{value: value}
+		if len(args) >= 4 && args[2].(string) == "EX" {
+			entry.expiresAt = time.Now().Add(time.Duration(toInt(args[3])) * time.Second)
+		}
+		c.pool.data[key] = entry
+		return "OK", nil
+	case "GET":
+		key := args[0].(string)
+		entry, ok := c.pool.data[key]
+		if !ok || (!entry.expiresAt.IsZero() && time.Now().After(entry.expiresAt)) {
+			return nil, nil
+		}
+		return entry.value, nil
+	case "EXPIRE":
+		key := args[0].(string)
+		entry, ok := c.pool.data[key]
+		if !ok {
+			return int64(0), nil
+		}
+		entry.expiresAt = time.Now().Add(time.Duration(toInt(args[1])) * time.Second)
+		c.pool.data[key] = entry
+		return int64(1), nil
+	case "DEL":
+		key := args[0].(string)
+		delete(c.pool.data, key)
+		return int64(1), nil
+	}
+	return nil, nil
+}
+
+func toInt(v interface{}) int {
+	switch n := v.(type) {
+	case int:
+		return n
+	case int64:
+		return int(n)
+	default:
+		return 0
+	}
+}
+
+func newTestTicketStore() (*RedisTicketStore, *fakeRedisPool) {
+	pool := newFakeRedisPool()
+	store := NewRedisTicketStore(pool, []byte("0123456789abcdef0123456789abcdef"))
+	store.Options.Secure = false
+	return store, pool
+}
+
+func TestRedisTicketStore_SaveAndLoadRoundTrip(t *testing.T) {
+	store, _ := newTestTicketStore()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	session, err := store.New(req, "cf-deck-session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !session.IsNew {
+		t.Fatal("expected brand new session to be marked IsNew")
+	}
+	session.Values["user"] = "alice"
+
+	rec := httptest.NewRecorder()
+	if err := store.Save(req, rec, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	cookies := rec.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("expected exactly one cookie, got %d", len(cookies))
+	}
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	req2.AddCookie(cookies[0])
+	got, err := store.New(req2, "cf-deck-session")
+	if err != nil {
+		t.Fatalf("New (reload): %v", err)
+	}
+	if got.IsNew {
+		t.Fatal("expected reloaded session to not be new")
+	}
+	if got.Values["user"] != "alice" {
+		t.Fatalf("expected user=alice, got %v", got.Values["user"])
+	}
+}
+
+func TestRedisTicketStore_TamperedCookieFallsBackToFreshSession(t *testing.T) {
+	store, _ := newTestTicketStore()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	session, _ := store.New(req, "cf-deck-session")
+	session.Values["user"] = "alice"
+
+	rec := httptest.NewRecorder()
+	if err := store.Save(req, rec, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookie := rec.Result().Cookies()[0]
+	cookie.Value = cookie.Value + "tampered"
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	req2.AddCookie(cookie)
+	got, err := store.New(req2, "cf-deck-session")
+	if err != nil {
+		t.Fatalf("New should swallow a tampered ticket, got error: %v", err)
+	}
+	if !got.IsNew {
+		t.Fatal("expected a tampered cookie to fall back to a fresh session")
+	}
+	if len(got.Values) != 0 {
+		t.Fatalf("expected no leaked values from a tampered cookie, got %v", got.Values)
+	}
+}
+
+func TestRedisTicketStore_MaxLifetimeExpires(t *testing.T) {
+	store, _ := newTestTicketStore()
+	store.MaxLifetime = 10 * time.Millisecond
+
+	req := httptest.NewRequest("GET", "/", nil)
+	session, _ := store.New(req, "cf-deck-session")
+	session.Values["user"] = "alice"
+
+	rec := httptest.NewRecorder()
+	if err := store.Save(req, rec, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookie := rec.Result().Cookies()[0]
+
+	time.Sleep(20 * time.Millisecond)
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	req2.AddCookie(cookie)
+	got, err := store.New(req2, "cf-deck-session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !got.IsNew {
+		t.Fatal("expected a session past MaxLifetime to come back fresh")
+	}
+}
+
+// TestRedisTicketStore_MaxLifetimeSurvivesActiveUse guards against
+// CreatedAt getting reset to time.Now() on every Save: an actively-used
+// session (re-saved well within MaxLifetime) must still expire once its
+// original creation time is old enough, not keep sliding forward.
+func TestRedisTicketStore_MaxLifetimeSurvivesActiveUse(t *testing.T) {
+	store, _ := newTestTicketStore()
+	store.MaxLifetime = 50 * time.Millisecond
+
+	req := httptest.NewRequest("GET", "/", nil)
+	session, _ := store.New(req, "cf-deck-session")
+	session.Values["user"] = "alice"
+
+	rec := httptest.NewRecorder()
+	if err := store.Save(req, rec, session); err != nil {
+		t.Fatalf("initial Save: %v", err)
+	}
+	cookie := rec.Result().Cookies()[0]
+
+	// Simulate a handful of active requests re-saving the same session
+	// well inside MaxLifetime, as an authenticated request typically does
+	// on every hit.
+	for i := 0; i < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+
+		req = httptest.NewRequest("GET", "/", nil)
+		req.AddCookie(cookie)
+		session, err := store.New(req, "cf-deck-session")
+		if err != nil {
+			t.Fatalf("New (iteration %d): %v", i, err)
+		}
+		if session.IsNew {
+			t.Fatalf("session unexpectedly reset to new on iteration %d", i)
+		}
+
+		rec = httptest.NewRecorder()
+		if err := store.Save(req, rec, session); err != nil {
+			t.Fatalf("Save (iteration %d): %v", i, err)
+		}
+		cookie = rec.Result().Cookies()[0]
+	}
+
+	// Wait until the original creation time is past MaxLifetime, while the
+	// last re-save is still well inside it.
+	time.Sleep(30 * time.Millisecond)
+
+	req = httptest.NewRequest("GET", "/", nil)
+	req.AddCookie(cookie)
+	got, err := store.New(req, "cf-deck-session")
+	if err != nil {
+		t.Fatalf("final New: %v", err)
+	}
+	if !got.IsNew {
+		t.Fatal("expected MaxLifetime to fire for an actively re-saved session once its original creation time is old enough")
+	}
+}
+
+// TestRedisTicketStore_SecretStableAcrossSaves guards against minting a
+// new per-session secret on every Save: two requests racing on the same
+// session must not be able to leave the browser's cookie and the Redis
+// ciphertext signed under different secrets.
+func TestRedisTicketStore_SecretStableAcrossSaves(t *testing.T) {
+	store, _ := newTestTicketStore()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	session, _ := store.New(req, "cf-deck-session")
+	session.Values["user"] = "alice"
+
+	rec := httptest.NewRecorder()
+	if err := store.Save(req, rec, session); err != nil {
+		t.Fatalf("initial Save: %v", err)
+	}
+	firstCookie := rec.Result().Cookies()[0]
+
+	// Load the session back and save it again, as a second request for
+	// the same session would.
+	req2 := httptest.NewRequest("GET", "/", nil)
+	req2.AddCookie(firstCookie)
+	session2, err := store.New(req2, "cf-deck-session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	rec2 := httptest.NewRecorder()
+	if err := store.Save(req2, rec2, session2); err != nil {
+		t.Fatalf("second Save: %v", err)
+	}
+
+	// The first cookie must still work: if Save had rotated the secret,
+	// the Redis ciphertext would now be sealed under a key the first
+	// cookie's ticket no longer carries, and this would fail to decrypt.
+	req3 := httptest.NewRequest("GET", "/", nil)
+	req3.AddCookie(firstCookie)
+	got, err := store.New(req3, "cf-deck-session")
+	if err != nil {
+		t.Fatalf("New with first cookie after a second save: %v", err)
+	}
+	if got.IsNew {
+		t.Fatal("expected the original cookie to still decrypt the session after a second save rotated nothing")
+	}
+	if got.Values["user"] != "alice" {
+		t.Fatalf("expected user=alice, got %v", got.Values["user"])
+	}
+}
+
+func TestRedisTicketStore_IdleTimeoutExpiresFromRedis(t *testing.T) {
+	store, _ := newTestTicketStore()
+	store.IdleTimeout = 10 * time.Millisecond
+
+	req := httptest.NewRequest("GET", "/", nil)
+	session, _ := store.New(req, "cf-deck-session")
+	session.Values["user"] = "alice"
+
+	rec := httptest.NewRecorder()
+	if err := store.Save(req, rec, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	cookie := rec.Result().Cookies()[0]
+
+	time.Sleep(20 * time.Millisecond)
+
+	req2 := httptest.NewRequest("GET", "/", nil)
+	req2.AddCookie(cookie)
+	got, err := store.New(req2, "cf-deck-session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !got.IsNew {
+		t.Fatal("expected the Redis key to have expired (idle timeout), yielding a fresh session")
+	}
+}
+
+func TestEncryptDecryptWithSecretRoundTrip(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	plaintext := []byte("super secret session payload")
+
+	ciphertext, err := encryptWithSecret(secret, plaintext)
+	if err != nil {
+		t.Fatalf("encryptWithSecret: %v", err)
+	}
+
+	got, err := decryptWithSecret(secret, ciphertext)
+	if err != nil {
+		t.Fatalf("decryptWithSecret: %v", err)
+	}
+	if string(got) != string(plaintext) {
+		t.Fatalf("expected %q, got %q", plaintext, got)
+	}
+}
+
+func TestDecryptWithSecretRejectsTamperedCiphertext(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	ciphertext, err := encryptWithSecret(secret, []byte("super secret session payload"))
+	if err != nil {
+		t.Fatalf("encryptWithSecret: %v", err)
+	}
+	ciphertext[len(ciphertext)-1] ^= 0xFF
+
+	if _, err := decryptWithSecret(secret, ciphertext); err == nil {
+		t.Fatal("expected decryption of tampered ciphertext to fail")
+	}
+}
+
+func TestDecryptWithSecretRejectsWrongSecret(t *testing.T) {
+	secret := []byte("0123456789abcdef0123456789abcdef")
+	wrongSecret := []byte("fedcba9876543210fedcba9876543210")
+	ciphertext, err := encryptWithSecret(secret, []byte("super secret session payload"))
+	if err != nil {
+		t.Fatalf("encryptWithSecret: %v", err)
+	}
+
+	if _, err := decryptWithSecret(wrongSecret, ciphertext); err == nil {
+		t.Fatal("expected decryption with the wrong per-session secret to fail")
+	}
+}
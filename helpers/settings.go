@@ -11,7 +11,6 @@ import (
 	"os"
 	"time"
 
-	"github.com/boj/redistore"
 	"github.com/cloudfoundry-community/go-cfenv"
 	"github.com/garyburd/redigo/redis"
 	"github.com/gorilla/sessions"
@@ -71,6 +70,22 @@ type Settings struct {
 	SMTPFrom string
 	// Shared secret with CF API proxy
 	TICSecret string
+	// JWKSURL is the JSON Web Key Set endpoint used to verify ID tokens,
+	// populated when OAUTH_USE_OIDC_DISCOVERY discovers it. Empty otherwise.
+	JWKSURL string
+	// SessionMaxLifetime bounds a session's age regardless of activity.
+	SessionMaxLifetime time.Duration
+	// SessionIdleTimeout deletes a session that has gone untouched for
+	// this long, even if its cookie's MaxAge hasn't elapsed.
+	SessionIdleTimeout time.Duration
+	// RedisPool is the shared Redis connection pool backing the
+	// redis-ticket session store and, when enabled, the rate limiter. Nil
+	// unless SessionBackend is "redis-ticket".
+	RedisPool RedisPool
+
+	// rateLimiter backs CheckAuthRate. Nil (always-allow) unless
+	// AUTH_RATE_LIMIT is configured.
+	rateLimiter rateLimiter
 }
 
 // CreateContext returns a new context to be used for http connections.
@@ -123,14 +138,24 @@ func (s *Settings) InitSettings(envVars *EnvVars, env *cfenv.App) (retErr error)
 	}
 
 	// Setup OAuth2 Client Service.
+	authURL, tokenURL := s.LoginURL+"/oauth/authorize", s.UaaURL+"/oauth/token"
+	if envVars.BoolGet(OAuthUseOIDCDiscoveryEnvVar) {
+		discoveredAuthURL, discoveredTokenURL, jwksURL, err := discoverOIDCEndpoints(s.UaaURL, s.LocalCF)
+		if err != nil {
+			return err
+		}
+		authURL, tokenURL = discoveredAuthURL, discoveredTokenURL
+		s.JWKSURL = jwksURL
+	}
+
 	s.OAuthConfig = &oauth2.Config{
 		ClientID:     envVars.MustGet(ClientIDEnvVar),
 		ClientSecret: envVars.MustGet(ClientSecretEnvVar),
 		RedirectURL:  s.AppURL + "/oauth2callback",
-		Scopes:       []string{"cloud_controller.read", "cloud_controller.write", "cloud_controller.admin", "scim.read", "openid"},
+		Scopes:       oauthScopes(envVars.Get(OAuthScopesEnvVar, ""), defaultOAuthScopes),
 		Endpoint: oauth2.Endpoint{
-			AuthURL:  envVars.MustGet(LoginURLEnvVar) + "/oauth/authorize",
-			TokenURL: envVars.MustGet(UAAURLEnvVar) + "/oauth/token",
+			AuthURL:  authURL,
+			TokenURL: tokenURL,
 		},
 	}
 
@@ -138,48 +163,51 @@ func (s *Settings) InitSettings(envVars *EnvVars, env *cfenv.App) (retErr error)
 		return GenerateRandomString(32)
 	}
 
+	s.SessionMaxLifetime = envVars.DurationGet(SessionMaxLifetimeEnvVar, 0)
+	s.SessionIdleTimeout = envVars.DurationGet(SessionIdleTimeoutEnvVar, 0)
+
 	// Initialize Sessions.
-	switch envVars.Get(SessionBackendEnvVar, "") {
-	case "redis":
-		address, password, err := getRedisSettings(env)
+	sessionBackend := envVars.Get(SessionBackendEnvVar, "")
+	switch sessionBackend {
+	case "redis", "redis-ticket":
+		if sessionBackend == "redis" {
+			// "redis" named the old redistore-backed store, which stored the
+			// full session server-side keyed by a single shared secret.
+			// "redis-ticket" replaced it with per-session encryption; alias
+			// the old value rather than silently falling through to the
+			// single-instance file store on upgrade.
+			log.Printf("{\"session-backend-deprecated\": \"SESSION_BACKEND=redis is deprecated, using redis-ticket instead\"}")
+		}
+
+		redisPool, healthCheck, err := buildRedisPool(envVars, env)
 		if err != nil {
 			return err
 		}
-		// Create a common redis pool of connections.
-		redisPool := &redis.Pool{
-			MaxIdle:     10,
-			IdleTimeout: 240 * time.Second,
-			TestOnBorrow: func(c redis.Conn, t time.Time) error {
-				_, pingErr := c.Do("PING")
-				return pingErr
-			},
-			Dial: func() (redis.Conn, error) {
-				// We need to control how long connections are attempted.
-				// Currently will limit how long redis should respond back to
-				// 10 seconds. Any time less than the overall connection timeout of 60
-				// seconds is good.
-				c, dialErr := redis.Dial("tcp", address,
-					redis.DialConnectTimeout(10*time.Second),
-					redis.DialWriteTimeout(10*time.Second),
-					redis.DialReadTimeout(10*time.Second))
-				if dialErr != nil {
-					return nil, dialErr
-				}
-				if password != "" {
-					if _, authErr := c.Do("AUTH", password); err != nil {
-						c.Close()
-						return nil, authErr
-					}
-				}
-				return c, nil
-			},
+		s.RedisPool = redisPool
+
+		// Only the ticket (session ID + per-session secret) ever reaches the
+		// cookie; the payload itself stays in Redis, encrypted under that
+		// secret. There's no cookie-size budget to protect, so we don't
+		// need the SetMaxLength fudge the old redistore-backed store required.
+		store := NewRedisTicketStore(redisPool, []byte(envVars.MustGet(SessionKeyEnvVar)))
+		store.MaxLifetime = s.SessionMaxLifetime
+		store.IdleTimeout = s.SessionIdleTimeout
+		store.Options = &sessions.Options{
+			HttpOnly: true,
+			MaxAge:   expirationConstant,
+			Path:     "/",
+			Secure:   s.SecureCookies,
 		}
-		// create our redis pool.
-		store, err := redistore.NewRediStoreWithPool(redisPool, []byte(envVars.MustGet(SessionKeyEnvVar)))
-		if err != nil {
-			return err
+		s.Sessions = store
+		s.SessionBackend = "redis-ticket"
+		s.SessionBackendHealthCheck = healthCheck
+	case "jwt":
+		var encKey []byte
+		if k := envVars.Get(JWTEncKeyEnvVar, ""); k != "" {
+			encKey = []byte(k)
 		}
-		store.SetMaxLength(4096 * 4)
+		store := NewJWTStore([]byte(envVars.MustGet(JWTSecretEnvVar)), encKey)
+		store.IdleTimeout = envVars.DurationGet(TokenIdleTimeoutEnvVar, 0)
 		store.Options = &sessions.Options{
 			HttpOnly: true,
 			MaxAge:   expirationConstant,
@@ -187,19 +215,20 @@ func (s *Settings) InitSettings(envVars *EnvVars, env *cfenv.App) (retErr error)
 			Secure:   s.SecureCookies,
 		}
 		s.Sessions = store
-		s.SessionBackend = "redis"
-
-		// Use health check function where we do a PING.
-		s.SessionBackendHealthCheck = func() bool {
-			c := redisPool.Get()
-			defer c.Close()
-			_, err := c.Do("PING")
-			if err != nil {
-				log.Printf("{\"health-check-error\": \"%s\"}", err)
-				return false
-			}
-			return true
+		s.SessionBackend = "jwt"
+		s.SessionBackendHealthCheck = func() bool { return true }
+	case "cookie":
+		store := sessions.NewCookieStore([]byte(envVars.MustGet(SessionKeyEnvVar)))
+		store.MaxAge(expirationConstant)
+		store.Options = &sessions.Options{
+			HttpOnly: true,
+			MaxAge:   expirationConstant,
+			Path:     "/",
+			Secure:   s.SecureCookies,
 		}
+		s.Sessions = store
+		s.SessionBackend = "cookie"
+		s.SessionBackendHealthCheck = func() bool { return true }
 	default:
 		store := sessions.NewFilesystemStore("", []byte(envVars.MustGet(SessionKeyEnvVar)))
 		store.MaxLength(4096 * 4)
@@ -219,11 +248,26 @@ func (s *Settings) InitSettings(envVars *EnvVars, env *cfenv.App) (retErr error)
 	// Want to save a struct into the session. Have to register it.
 	gob.Register(oauth2.Token{})
 
+	if spec := envVars.Get(AuthRateLimitEnvVar, ""); spec != "" {
+		limit, window, err := parseAuthRateLimit(spec)
+		if err != nil {
+			return err
+		}
+		if s.RedisPool != nil {
+			s.rateLimiter = &redisRateLimiter{pool: s.RedisPool, limit: limit, window: window}
+		} else {
+			// No Redis backend configured (e.g. SessionBackend is "cookie"
+			// or "file"); fall back to an in-process limiter so tests and
+			// local dev still enforce the limit.
+			s.rateLimiter = newLocalRateLimiter(limit, window)
+		}
+	}
+
 	s.HighPrivilegedOauthConfig = &clientcredentials.Config{
 		ClientID:     envVars.MustGet(ClientIDEnvVar),
 		ClientSecret: envVars.MustGet(ClientSecretEnvVar),
-		Scopes:       []string{"scim.invite", "cloud_controller.admin", "scim.read"},
-		TokenURL:     envVars.MustGet(UAAURLEnvVar) + "/oauth/token",
+		Scopes:       oauthScopes(envVars.Get(OAuthAdminScopesEnvVar, ""), defaultOAuthAdminScopes),
+		TokenURL:     tokenURL,
 	}
 
 	s.SMTPFrom = envVars.MustGet(SMTPFromEnvVar)
@@ -235,6 +279,39 @@ func (s *Settings) InitSettings(envVars *EnvVars, env *cfenv.App) (retErr error)
 	return nil
 }
 
+// newRedisPool builds the common redis pool of connections shared by every
+// redis-backed subsystem (sessions, rate limiting, ...).
+func newRedisPool(address, password string) *redis.Pool {
+	return &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 240 * time.Second,
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, pingErr := c.Do("PING")
+			return pingErr
+		},
+		Dial: func() (redis.Conn, error) {
+			// We need to control how long connections are attempted.
+			// Currently will limit how long redis should respond back to
+			// 10 seconds. Any time less than the overall connection timeout of 60
+			// seconds is good.
+			c, dialErr := redis.Dial("tcp", address,
+				redis.DialConnectTimeout(10*time.Second),
+				redis.DialWriteTimeout(10*time.Second),
+				redis.DialReadTimeout(10*time.Second))
+			if dialErr != nil {
+				return nil, dialErr
+			}
+			if password != "" {
+				if _, authErr := c.Do("AUTH", password); authErr != nil {
+					c.Close()
+					return nil, authErr
+				}
+			}
+			return c, nil
+		},
+	}
+}
+
 func getRedisSettings(env *cfenv.App) (string, string, error) {
 	var err error
 	// Try to read directly from REDIS_URI first.